@@ -4,12 +4,11 @@
 
 package bindings2
 
-// TODO(mknyszek): Support unions, handles, interfaces, strings, and vectors.
+// TODO(mknyszek): Support interfaces.
 
 import (
 	"errors"
 	"fmt"
-	"math"
 	"reflect"
 	"syscall/zx"
 )
@@ -72,76 +71,114 @@ func (e *encoder) writeUint(val uint64, size int) {
 	e.head += size
 }
 
-// marshal is the central recursive function core to marshalling, and
-// traverses the tree-like structure of the input type t. v represents
-// the value associated with the type t.
+// marshal traverses the tree-like structure of the input type t, writing it
+// to the buffer. v represents the value associated with the type t.
 //
 // It marshals only exported struct fields.
+//
+// The traversal itself is driven by the cached typeInfo for t rather than by
+// recursing on t.Kind() directly; see typeinfo.go.
 func (e *encoder) marshal(t reflect.Type, v reflect.Value) error {
-	switch t.Kind() {
-	case reflect.Array:
-		elemType := t.Elem()
-		for i := 0; i < t.Len(); i++ {
-			if err := e.marshal(elemType, v.Index(i)); err != nil {
-				return err
-			}
-		}
-	case reflect.Bool:
-		// Encodes bools with 1 byte, just like FIDL.
-		i := uint64(0)
-		if v.Bool() {
-			i = 1
-		}
-		e.writeUint(i, 1)
-	case reflect.Int8:
-		e.writeInt(v.Int(), 1)
-	case reflect.Int16:
-		e.writeInt(v.Int(), 2)
-	case reflect.Int32:
-		e.writeInt(v.Int(), 4)
-	case reflect.Int64:
-		e.writeInt(v.Int(), 8)
-	case reflect.Uint8:
-		e.writeUint(v.Uint(), 1)
-	case reflect.Uint16:
-		e.writeUint(v.Uint(), 2)
-	case reflect.Uint32:
-		e.writeUint(v.Uint(), 4)
-	case reflect.Uint64:
-		e.writeUint(v.Uint(), 8)
-	case reflect.Float32:
-		e.writeUint(uint64(math.Float32bits(float32(v.Float()))), 4)
-	case reflect.Float64:
-		e.writeUint(math.Float64bits(v.Float()), 8)
-	case reflect.Struct:
-		// Get the alignment for the struct, and then align to it.
-		//
-		// Note that Addr can fail if the originally derived value is not "addressable",
-		// meaning the root ValueOf() call was on a struct value, not a pointer. However,
-		// we guarantee the struct is addressable by forcing a Payload to be passed in
-		// (a struct value will never cast as an interface).
-		//
-		// We avoid using Implements(), MethodByName(), and Call() here because they're
-		// very slow.
-		payload, ok := v.Addr().Interface().(Payload)
-		if !ok {
-			return fmt.Errorf("struct %s must implement Payload", t.Name())
-		}
-		e.head = align(e.head, payload.InlineAlignment())
-		for i := 0; i < t.NumField(); i++ {
-			f := t.Field(i)
-			// If it's an unexported field, ignore it.
-			if f.PkgPath != "" {
-				continue
-			}
-			if err := e.marshal(f.Type, v.Field(i)); err != nil {
-				return err
-			}
-		}
-	default:
-		return fmt.Errorf("unsupported type kind %s for type %s", t.Kind(), t.Name())
+	info, err := getTypeInfo(t)
+	if err != nil {
+		return err
 	}
-	return nil
+	return e.marshalInfo(info, v, noMax)
+}
+
+// Encoder is the view of an in-progress encode exposed to a Marshaler's
+// MarshalFIDL, so that it can append inline bytes, contribute handles, and
+// grow the out-of-line region without reaching into encoder's unexported
+// fields (which, unlike Payload, live in this package while Marshaler
+// implementations are generated into arbitrary other packages).
+type Encoder struct {
+	e *encoder
+}
+
+// WriteBytes copies b into the buffer at the encoder's current position,
+// advancing past it. The caller is responsible for any alignment padding
+// the FIDL wire format requires before calling WriteBytes.
+func (enc *Encoder) WriteBytes(b []byte) {
+	copy(enc.e.buffer[enc.e.head:enc.e.head+len(b)], b)
+	enc.e.head += len(b)
+}
+
+// AppendHandle records h as discovered in wire traversal order, so that it
+// is returned alongside the encoded bytes by Marshal.
+func (enc *Encoder) AppendHandle(h zx.Handle) {
+	enc.e.handles = append(enc.e.handles, h)
+}
+
+// ReserveOutOfLine grows the buffer by size bytes (rounded up to an 8-byte
+// boundary) in the out-of-line region and returns that span for the caller
+// to fill in. The caller must finish writing into the returned slice before
+// calling ReserveOutOfLine again: a later call may grow the buffer's
+// backing array, which leaves any slice returned by an earlier call
+// pointing at stale memory.
+func (enc *Encoder) ReserveOutOfLine(size int) []byte {
+	start := enc.e.reserveSecondary(size)
+	return enc.e.buffer[start : start+size]
+}
+
+// Marshaler is implemented by generated types that know how to encode
+// themselves directly, without going through the reflection-based encoder.
+//
+// MarshalFIDL writes the FIDL encoding of the receiver's first Size()
+// bytes using enc, which is positioned at the start of the receiver's
+// reserved inline span, and uses enc to append any handles the receiver
+// owns and to grow the out-of-line region for any strings, vectors, or
+// nullable structs it contains.
+//
+// Types implementing Marshaler are expected to produce byte-for-byte
+// identical output to what encoder.marshal would produce for the same
+// value; Marshal uses a type assertion to prefer this path when available,
+// falling back to reflection otherwise.
+type Marshaler interface {
+	Size() int
+	MarshalFIDL(enc *Encoder) error
+}
+
+// Decoder is the view of an in-progress decode exposed to an Unmarshaler's
+// UnmarshalFIDL; see Encoder.
+type Decoder struct {
+	d *decoder
+}
+
+// ReadBytes returns the next n bytes from the buffer, advancing past them.
+func (dec *Decoder) ReadBytes(n int) []byte {
+	b := dec.d.buffer[dec.d.head : dec.d.head+n]
+	dec.d.head += n
+	return b
+}
+
+// NextHandle pops the next handle from the message, in wire traversal
+// order, or returns an error if the message has no handles left.
+func (dec *Decoder) NextHandle() (zx.Handle, error) {
+	if dec.d.handleIdx >= len(dec.d.handles) {
+		return 0, fmt.Errorf("not enough handles to unmarshal")
+	}
+	h := dec.d.handles[dec.d.handleIdx]
+	dec.d.handleIdx++
+	return h, nil
+}
+
+// ReadOutOfLine claims the next size bytes of the out-of-line region and
+// returns them for the caller to decode.
+func (dec *Decoder) ReadOutOfLine(size int) ([]byte, error) {
+	start, err := dec.d.readSecondary(size)
+	if err != nil {
+		return nil, err
+	}
+	return dec.d.buffer[start : start+size], nil
+}
+
+// Unmarshaler is implemented by generated types that know how to decode
+// themselves directly, without going through the reflection-based decoder.
+//
+// UnmarshalFIDL reads the FIDL encoding of the receiver using dec, popping
+// handles and out-of-line bytes from it in traversal order.
+type Unmarshaler interface {
+	UnmarshalFIDL(dec *Decoder) error
 }
 
 func marshalHeader(header *MessageHeader) []byte {
@@ -173,10 +210,21 @@ func Marshal(header *MessageHeader, s Payload) ([]byte, []zx.Handle, error) {
 		return nil, nil, errors.New("primary object must be a struct")
 	}
 
-	// Now, let's get the value of s, marshal the header into a starting
-	// buffer, and then marshal the rest of the payload in s.
-	v := reflect.ValueOf(s).Elem()
+	// Marshal the header into a starting buffer, then marshal the payload
+	// in s. If s implements Marshaler, prefer its hand (or generator)
+	// written encoding over the reflection-based path below: it already
+	// knows its own field offsets and avoids a reflect.Value.Field call
+	// and a Payload assertion per nested struct.
 	e := encoder{buffer: marshalHeader(header)}
+	if m, ok := s.(Marshaler); ok {
+		e.head = e.newObject(m.Size())
+		if err := m.MarshalFIDL(&Encoder{e: &e}); err != nil {
+			return nil, nil, err
+		}
+		return e.buffer, e.handles, nil
+	}
+
+	v := reflect.ValueOf(s).Elem()
 	e.head = e.newObject(s.InlineSize())
 	if err := e.marshal(t, v); err != nil {
 		return nil, nil, err
@@ -191,6 +239,18 @@ type decoder struct {
 
 	// buffer represents the buffer we're decoding from.
 	buffer []byte
+
+	// oolHead is the offset of the next unclaimed byte in the out-of-line
+	// region of buffer, i.e. the region holding string/vector contents and
+	// nullable struct bodies. It advances monotonically as those objects
+	// are read, in the same depth-first order the encoder appended them.
+	oolHead int
+
+	// handles are the handles that came in alongside buffer, to be popped
+	// off (via handleIdx) in the same traversal order the encoder found
+	// them in.
+	handles   []zx.Handle
+	handleIdx int
 }
 
 // readInt reads a signed integer value of byte-width size from the buffer.
@@ -220,79 +280,19 @@ func (d *decoder) readUint(size int) uint64 {
 	return val
 }
 
-// unmarshal is the central recursive function core to unmarshalling, and
-// traverses the tree-like structure of the input type t. v represents
-// the value associated with the type t.
+// unmarshal traverses the tree-like structure of the input type t, reading
+// it from the buffer. v represents the value associated with the type t.
 //
 // It unmarshals only exported struct fields.
+//
+// The traversal itself is driven by the cached typeInfo for t rather than by
+// recursing on t.Kind() directly; see typeinfo.go.
 func (d *decoder) unmarshal(t reflect.Type, v reflect.Value) error {
-	switch t.Kind() {
-	case reflect.Array:
-		elemType := t.Elem()
-		for i := 0; i < t.Len(); i++ {
-			if err := d.unmarshal(elemType, v.Index(i)); err != nil {
-				return err
-			}
-		}
-	case reflect.Bool:
-		i := d.readUint(1)
-		switch i {
-		case 0:
-			v.SetBool(false)
-		case 1:
-			v.SetBool(true)
-		default:
-			return fmt.Errorf("%d is not a valid bool value", i)
-		}
-	case reflect.Int8:
-		v.SetInt(d.readInt(1))
-	case reflect.Int16:
-		v.SetInt(d.readInt(2))
-	case reflect.Int32:
-		v.SetInt(d.readInt(4))
-	case reflect.Int64:
-		v.SetInt(d.readInt(8))
-	case reflect.Uint8:
-		v.SetUint(d.readUint(1))
-	case reflect.Uint16:
-		v.SetUint(d.readUint(2))
-	case reflect.Uint32:
-		v.SetUint(d.readUint(4))
-	case reflect.Uint64:
-		v.SetUint(d.readUint(8))
-	case reflect.Float32:
-		v.SetFloat(float64(math.Float32frombits(uint32(d.readUint(4)))))
-	case reflect.Float64:
-		v.SetFloat(math.Float64frombits(d.readUint(8)))
-	case reflect.Struct:
-		// Get the alignment for the struct, and then align to it.
-		//
-		// Note that Addr can fail if the originally derived value is not "addressable",
-		// meaning the root ValueOf() call was on a struct value, not a pointer. However,
-		// we guarantee the struct is addressable by forcing a Payload to be passed in
-		// (a struct value will never cast as an interface).
-		//
-		// We avoid using Implements(), MethodByName(), and Call() here because they're
-		// very slow.
-		payload, ok := v.Addr().Interface().(Payload)
-		if !ok {
-			return fmt.Errorf("struct %s must implement Payload", t.Name())
-		}
-		d.head = align(d.head, payload.InlineAlignment())
-		for i := 0; i < t.NumField(); i++ {
-			f := t.Field(i)
-			// If it's an unexported field, ignore it.
-			if f.PkgPath != "" {
-				continue
-			}
-			if err := d.unmarshal(f.Type, v.Field(i)); err != nil {
-				return err
-			}
-		}
-	default:
-		return fmt.Errorf("unsupported type kind %s", t.Kind())
+	info, err := getTypeInfo(t)
+	if err != nil {
+		return err
 	}
-	return nil
+	return d.unmarshalInfo(info, v, noMax)
 }
 
 func unmarshalHeader(data []byte, m *MessageHeader) error {
@@ -315,7 +315,7 @@ func unmarshalHeader(data []byte, m *MessageHeader) error {
 // by the structure of the struct pointed to by s.
 //
 // TODO(mknyszek): More rigorously validate the input.
-func Unmarshal(data []byte, _ []zx.Handle, s Payload) (*MessageHeader, error) {
+func Unmarshal(data []byte, handles []zx.Handle, s Payload) (*MessageHeader, error) {
 	// First, let's make sure we have the right type in s.
 	t := reflect.TypeOf(s)
 	if t.Kind() != reflect.Ptr {
@@ -332,7 +332,19 @@ func Unmarshal(data []byte, _ []zx.Handle, s Payload) (*MessageHeader, error) {
 		return nil, err
 	}
 
-	// Get the payload's value and unmarshal it.
-	d := decoder{buffer: data[MessageHeaderSize:]}
+	// Get the payload's value and unmarshal it. The out-of-line region
+	// starts right after the primary object's own (8-byte-aligned) inline
+	// bytes, mirroring how Marshal's e.newObject(s.InlineSize()) reserves
+	// that same span before any out-of-line data is appended.
+	payload := data[MessageHeaderSize:]
+	d := decoder{buffer: payload, handles: handles, oolHead: align(s.InlineSize(), 8)}
+
+	// If s implements Unmarshaler, prefer its own decoding over the
+	// reflection-based path below, for the same reasons Marshal prefers
+	// Marshaler.
+	if u, ok := s.(Unmarshaler); ok {
+		return &m, u.UnmarshalFIDL(&Decoder{d: &d})
+	}
+
 	return &m, d.unmarshal(t, reflect.ValueOf(s).Elem())
 }
@@ -0,0 +1,474 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package bindings2
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall/zx"
+)
+
+// FIDL wire sentinels for the presence/pointer slot of an out-of-line
+// object, and for a handle slot.
+const (
+	allocAbsent  = uint64(0)
+	allocPresent = ^uint64(0)
+
+	handleAbsentSentinel  = uint32(0)
+	handlePresentSentinel = ^uint32(0)
+)
+
+// HandleMarshaler is implemented by types that wrap a zx.Handle (or a more
+// specific handle subtype, e.g. a channel or vmo wrapper) and know how to
+// extract or restore the underlying handle during encoding/decoding. It lets
+// generated handle subtypes participate in marshalling without exposing
+// their underlying zx.Handle as an ordinary struct field.
+type HandleMarshaler interface {
+	GetHandle() zx.Handle
+	SetHandle(zx.Handle)
+}
+
+var (
+	handleType          = reflect.TypeOf(zx.Handle(0))
+	handleMarshalerType = reflect.TypeOf((*HandleMarshaler)(nil)).Elem()
+)
+
+// Union is implemented by generated types representing a FIDL union: a
+// struct in which exactly one of several variant fields is meaningful at a
+// time, selected by a discriminant tag. Each exported field is tagged
+// `fidl:"TAG=n"` with its variant's tag value; Which/SetWhich store the tag
+// of the currently-selected variant.
+type Union interface {
+	Which() uint32
+	SetWhich(uint32)
+}
+
+// isHandleType reports whether t is zx.Handle itself or a type whose pointer
+// implements HandleMarshaler.
+func isHandleType(t reflect.Type) bool {
+	return t == handleType || reflect.PtrTo(t).Implements(handleMarshalerType)
+}
+
+// parseFidlTag parses the value of a `fidl:"..."` struct tag and extracts an
+// optional MAX=n component, e.g. `fidl:"str,MAX=256"`. An empty tag is valid
+// and means no maximum. hasMax is false if no MAX= component was present.
+func parseFidlTag(tag string) (max int, hasMax bool, err error) {
+	if tag == "" {
+		return 0, false, nil
+	}
+	for _, part := range strings.Split(tag, ",") {
+		part = strings.TrimSpace(part)
+		if !strings.HasPrefix(part, "MAX=") {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(part, "MAX="))
+		if err != nil {
+			return 0, false, fmt.Errorf("invalid MAX in fidl tag %q: %v", tag, err)
+		}
+		if n < 0 {
+			return 0, false, fmt.Errorf("invalid MAX in fidl tag %q: must be non-negative", tag)
+		}
+		return n, true, nil
+	}
+	return 0, false, nil
+}
+
+// parseUnionTag parses the value of a `fidl:"..."` struct tag on a union
+// variant field and extracts its TAG=n component, e.g. `fidl:"TAG=1"`. Every
+// exported field of a union type must declare one.
+func parseUnionTag(tag string) (unionTag uint32, err error) {
+	for _, part := range strings.Split(tag, ",") {
+		part = strings.TrimSpace(part)
+		if !strings.HasPrefix(part, "TAG=") {
+			continue
+		}
+		n, err := strconv.ParseUint(strings.TrimPrefix(part, "TAG="), 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid TAG in fidl tag %q: %v", tag, err)
+		}
+		return uint32(n), nil
+	}
+	return 0, fmt.Errorf("union variant field missing required TAG= in fidl tag %q", tag)
+}
+
+// buildUnionTypeInfo computes the typeInfo for a union type t: t's exported
+// fields are mutually exclusive variants, each tagged with the discriminant
+// value that selects it, occupying a shared data region that begins right
+// after the 4-byte tag (padded out to the widest variant's alignment). The
+// union's inline size is the tag, its padding, and that data region (sized
+// to the widest variant), rounded up to the union's own alignment.
+func buildUnionTypeInfo(t reflect.Type) (*typeInfo, error) {
+	payload, ok := reflect.New(t).Interface().(Payload)
+	if !ok {
+		return nil, fmt.Errorf("union %s must implement Payload", t.Name())
+	}
+
+	var variants []unionVariant
+	dataAlignment, dataSize := 1, 0
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		tag, err := parseUnionTag(f.Tag.Get("fidl"))
+		if err != nil {
+			return nil, fmt.Errorf("field %s.%s: %v", t.Name(), f.Name, err)
+		}
+		child, err := getTypeInfo(f.Type)
+		if err != nil {
+			return nil, err
+		}
+		variants = append(variants, unionVariant{tag: tag, index: i, info: child})
+		if child.alignment > dataAlignment {
+			dataAlignment = child.alignment
+		}
+		if child.size > dataSize {
+			dataSize = child.size
+		}
+	}
+
+	alignment := payload.InlineAlignment()
+	size := align(align(4, dataAlignment)+dataSize, alignment)
+	return &typeInfo{
+		kind:          kindUnion,
+		size:          size,
+		alignment:     alignment,
+		unionVariants: variants,
+		dataAlignment: dataAlignment,
+	}, nil
+}
+
+// findUnionVariant returns the variant of info (a kindUnion typeInfo) whose
+// tag matches, if any.
+func findUnionVariant(info *typeInfo, tag uint32) (unionVariant, bool) {
+	for _, variant := range info.unionVariants {
+		if variant.tag == tag {
+			return variant, true
+		}
+	}
+	return unionVariant{}, false
+}
+
+// marshalUnion writes v, a union described by info: a 4-byte discriminant
+// tag identifying the selected variant, followed (after padding to the
+// variant data's alignment) by that variant's own encoding. The union's
+// reserved size -- the tag and its padding plus max(variant sizes), rounded
+// to the union's alignment -- is consumed regardless of the selected variant's actual size; since e.buffer
+// is zero-extended when allocated and nothing is written past the selected
+// variant, the unused reserved bytes are left as the zero padding FIDL
+// expects for unselected variants.
+func (e *encoder) marshalUnion(info *typeInfo, v reflect.Value) error {
+	start := align(e.head, info.alignment)
+	e.head = start
+	u, ok := v.Addr().Interface().(Union)
+	if !ok {
+		return fmt.Errorf("%s must implement Union", v.Type())
+	}
+	tag := u.Which()
+	variant, ok := findUnionVariant(info, tag)
+	if !ok {
+		return fmt.Errorf("%s: tag %d does not match any union variant", v.Type(), tag)
+	}
+	e.writeUint(uint64(tag), 4)
+	e.head = align(e.head, info.dataAlignment)
+	if err := e.marshalInfo(variant.info, v.Field(variant.index), noMax); err != nil {
+		return err
+	}
+	e.head = start + info.size
+	return nil
+}
+
+// unmarshalUnion is the decoding counterpart to marshalUnion. It zeroes
+// every variant field but the selected one before decoding into it, so that
+// a reused Go value doesn't retain a stale previous selection, then calls
+// SetWhich to record the tag actually read off the wire.
+func (d *decoder) unmarshalUnion(info *typeInfo, v reflect.Value) error {
+	start := align(d.head, info.alignment)
+	d.head = start
+	tag := uint32(d.readUint(4))
+	variant, ok := findUnionVariant(info, tag)
+	if !ok {
+		return fmt.Errorf("%s: tag %d does not match any union variant", v.Type(), tag)
+	}
+	d.head = align(d.head, info.dataAlignment)
+	for _, other := range info.unionVariants {
+		if other.index != variant.index {
+			v.Field(other.index).Set(reflect.Zero(v.Field(other.index).Type()))
+		}
+	}
+	if err := d.unmarshalInfo(variant.info, v.Field(variant.index), noMax); err != nil {
+		return err
+	}
+	u, ok := v.Addr().Interface().(Union)
+	if !ok {
+		return fmt.Errorf("%s must implement Union", v.Type())
+	}
+	u.SetWhich(tag)
+	d.head = start + info.size
+	return nil
+}
+
+// reserveSecondary allocates size bytes (rounded up to an 8-byte boundary)
+// in the out-of-line region at the end of e.buffer, the same way newObject
+// reserves the primary object, and returns its start offset.
+func (e *encoder) reserveSecondary(size int) int {
+	return e.newObject(size)
+}
+
+// readSecondary claims size bytes from the out-of-line region of d.buffer,
+// starting at d.oolHead, and advances d.oolHead past it (rounded up to an
+// 8-byte boundary, matching reserveSecondary).
+func (d *decoder) readSecondary(size int) (int, error) {
+	start := d.oolHead
+	if size < 0 || start+size > len(d.buffer) {
+		return 0, fmt.Errorf("out-of-line object at offset %d of size %d exceeds buffer of length %d", start, size, len(d.buffer))
+	}
+	d.oolHead = align(start+size, 8)
+	return start, nil
+}
+
+// marshalHandle writes the handle described by info/v: a presence sentinel
+// inline, and (if present) the handle itself appended to e.handles.
+func (e *encoder) marshalHandle(info *typeInfo, v reflect.Value) error {
+	var h zx.Handle
+	if info.handleViaInterface {
+		hm, ok := v.Addr().Interface().(HandleMarshaler)
+		if !ok {
+			return fmt.Errorf("%s must implement HandleMarshaler", v.Type())
+		}
+		h = hm.GetHandle()
+	} else {
+		h = zx.Handle(v.Uint())
+	}
+	if h == 0 {
+		e.writeUint(uint64(handleAbsentSentinel), 4)
+		return nil
+	}
+	e.writeUint(uint64(handlePresentSentinel), 4)
+	e.handles = append(e.handles, h)
+	return nil
+}
+
+// marshalString writes a non-nullable FIDL string: an inline {size,
+// FIDL_ALLOC_PRESENT} slot followed by its bytes out-of-line.
+func (e *encoder) marshalString(v reflect.Value, maxSize int) error {
+	s := v.String()
+	if maxSize != noMax && len(s) > maxSize {
+		return fmt.Errorf("string of length %d exceeds MAX=%d", len(s), maxSize)
+	}
+	e.head = align(e.head, 8)
+	e.writeUint(uint64(len(s)), 8)
+	e.writeUint(allocPresent, 8)
+	start := e.reserveSecondary(len(s))
+	copy(e.buffer[start:start+len(s)], s)
+	return nil
+}
+
+// marshalNullableString writes a *string: absent if nil, otherwise the same
+// shape as marshalString.
+func (e *encoder) marshalNullableString(v reflect.Value, maxSize int) error {
+	e.head = align(e.head, 8)
+	if v.IsNil() {
+		e.writeUint(0, 8)
+		e.writeUint(allocAbsent, 8)
+		return nil
+	}
+	s := v.Elem().String()
+	if maxSize != noMax && len(s) > maxSize {
+		return fmt.Errorf("string of length %d exceeds MAX=%d", len(s), maxSize)
+	}
+	e.writeUint(uint64(len(s)), 8)
+	e.writeUint(allocPresent, 8)
+	start := e.reserveSecondary(len(s))
+	copy(e.buffer[start:start+len(s)], s)
+	return nil
+}
+
+// marshalVector writes a FIDL vector: absent if v is a nil slice, otherwise
+// an inline {count, FIDL_ALLOC_PRESENT} slot followed by its elements
+// out-of-line.
+func (e *encoder) marshalVector(info *typeInfo, v reflect.Value, maxSize int) error {
+	e.head = align(e.head, 8)
+	if v.IsNil() {
+		e.writeUint(0, 8)
+		e.writeUint(allocAbsent, 8)
+		return nil
+	}
+	n := v.Len()
+	if maxSize != noMax && n > maxSize {
+		return fmt.Errorf("vector of length %d exceeds MAX=%d", n, maxSize)
+	}
+	e.writeUint(uint64(n), 8)
+	e.writeUint(allocPresent, 8)
+
+	start := e.reserveSecondary(info.elem.size * n)
+	saved := e.head
+	e.head = start
+	for i := 0; i < n; i++ {
+		if err := e.marshalInfo(info.elem, v.Index(i), noMax); err != nil {
+			e.head = saved
+			return err
+		}
+	}
+	e.head = saved
+	return nil
+}
+
+// marshalNullableStruct writes a *StructType: absent if nil, otherwise an
+// inline FIDL_ALLOC_PRESENT slot followed by the struct's body out-of-line.
+func (e *encoder) marshalNullableStruct(info *typeInfo, v reflect.Value) error {
+	e.head = align(e.head, 8)
+	if v.IsNil() {
+		e.writeUint(allocAbsent, 8)
+		return nil
+	}
+	e.writeUint(allocPresent, 8)
+	start := e.reserveSecondary(info.elem.size)
+	saved := e.head
+	e.head = start
+	if err := e.marshalInfo(info.elem, v.Elem(), noMax); err != nil {
+		e.head = saved
+		return err
+	}
+	e.head = saved
+	return nil
+}
+
+// unmarshalHandle is the decoding counterpart to marshalHandle.
+func (d *decoder) unmarshalHandle(info *typeInfo, v reflect.Value) error {
+	sentinel := uint32(d.readUint(4))
+	var h zx.Handle
+	switch sentinel {
+	case handleAbsentSentinel:
+		h = 0
+	case handlePresentSentinel:
+		if d.handleIdx >= len(d.handles) {
+			return fmt.Errorf("not enough handles to unmarshal %s", v.Type())
+		}
+		h = d.handles[d.handleIdx]
+		d.handleIdx++
+	default:
+		return fmt.Errorf("invalid handle presence sentinel %#x", sentinel)
+	}
+	if info.handleViaInterface {
+		hm, ok := v.Addr().Interface().(HandleMarshaler)
+		if !ok {
+			return fmt.Errorf("%s must implement HandleMarshaler", v.Type())
+		}
+		hm.SetHandle(h)
+		return nil
+	}
+	v.SetUint(uint64(h))
+	return nil
+}
+
+// unmarshalString is the decoding counterpart to marshalString.
+func (d *decoder) unmarshalString(v reflect.Value, maxSize int) error {
+	size := d.readUint(8)
+	presence := d.readUint(8)
+	if presence != allocPresent {
+		return fmt.Errorf("non-nullable string is absent")
+	}
+	if maxSize != noMax && int(size) > maxSize {
+		return fmt.Errorf("string of length %d exceeds MAX=%d", size, maxSize)
+	}
+	start, err := d.readSecondary(int(size))
+	if err != nil {
+		return err
+	}
+	v.SetString(string(d.buffer[start : start+int(size)]))
+	return nil
+}
+
+// unmarshalNullableString is the decoding counterpart to
+// marshalNullableString.
+func (d *decoder) unmarshalNullableString(v reflect.Value, maxSize int) error {
+	size := d.readUint(8)
+	presence := d.readUint(8)
+	switch presence {
+	case allocAbsent:
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	case allocPresent:
+		if maxSize != noMax && int(size) > maxSize {
+			return fmt.Errorf("string of length %d exceeds MAX=%d", size, maxSize)
+		}
+		start, err := d.readSecondary(int(size))
+		if err != nil {
+			return err
+		}
+		s := string(d.buffer[start : start+int(size)])
+		v.Set(reflect.ValueOf(&s))
+		return nil
+	default:
+		return fmt.Errorf("invalid string presence sentinel %#x", presence)
+	}
+}
+
+// unmarshalVector is the decoding counterpart to marshalVector.
+func (d *decoder) unmarshalVector(info *typeInfo, v reflect.Value, maxSize int) error {
+	count := d.readUint(8)
+	presence := d.readUint(8)
+	switch presence {
+	case allocAbsent:
+		if count != 0 {
+			return fmt.Errorf("absent vector has non-zero length %d", count)
+		}
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	case allocPresent:
+		if maxSize != noMax && int(count) > maxSize {
+			return fmt.Errorf("vector of length %d exceeds MAX=%d", count, maxSize)
+		}
+		start, err := d.readSecondary(info.elem.size * int(count))
+		if err != nil {
+			return err
+		}
+		saved := d.head
+		d.head = start
+		slice := reflect.MakeSlice(v.Type(), int(count), int(count))
+		for i := 0; i < int(count); i++ {
+			if err := d.unmarshalInfo(info.elem, slice.Index(i), noMax); err != nil {
+				d.head = saved
+				return err
+			}
+		}
+		d.head = saved
+		v.Set(slice)
+		return nil
+	default:
+		return fmt.Errorf("invalid vector presence sentinel %#x", presence)
+	}
+}
+
+// unmarshalNullableStruct is the decoding counterpart to
+// marshalNullableStruct.
+func (d *decoder) unmarshalNullableStruct(info *typeInfo, v reflect.Value) error {
+	presence := d.readUint(8)
+	switch presence {
+	case allocAbsent:
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	case allocPresent:
+		start, err := d.readSecondary(info.elem.size)
+		if err != nil {
+			return err
+		}
+		saved := d.head
+		d.head = start
+		newVal := reflect.New(v.Type().Elem())
+		if err := d.unmarshalInfo(info.elem, newVal.Elem(), noMax); err != nil {
+			d.head = saved
+			return err
+		}
+		d.head = saved
+		v.Set(newVal)
+		return nil
+	default:
+		return fmt.Errorf("invalid struct presence sentinel %#x", presence)
+	}
+}
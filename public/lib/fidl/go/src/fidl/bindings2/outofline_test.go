@@ -0,0 +1,163 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package bindings2
+
+import (
+	"syscall/zx"
+	"testing"
+)
+
+type outOfLineInner struct {
+	Val int32
+}
+
+func (*outOfLineInner) InlineAlignment() int { return 4 }
+func (*outOfLineInner) InlineSize() int      { return 4 }
+
+type outOfLineStruct struct {
+	Name     string
+	Nums     []int32
+	Nullable *string
+	Inner    *outOfLineInner
+	H        zx.Handle
+}
+
+func (*outOfLineStruct) InlineAlignment() int { return 8 }
+func (*outOfLineStruct) InlineSize() int      { return 64 }
+
+// TestOutOfLineRoundTrip exercises strings, vectors, nullable strings,
+// nullable structs, and handles together through the reflection-based
+// encoder/decoder.
+func TestOutOfLineRoundTrip(t *testing.T) {
+	nullable := "present"
+	in := &outOfLineStruct{
+		Name:     "hello",
+		Nums:     []int32{1, 2, 3},
+		Nullable: &nullable,
+		Inner:    &outOfLineInner{Val: 42},
+		H:        zx.Handle(7),
+	}
+	header := &MessageHeader{Txid: 1, Ordinal: 2}
+	buf, handles, err := Marshal(header, in)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if len(handles) != 1 || handles[0] != zx.Handle(7) {
+		t.Fatalf("got handles %v, want [7]", handles)
+	}
+
+	var out outOfLineStruct
+	if _, err := Unmarshal(buf, handles, &out); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if out.Name != in.Name {
+		t.Errorf("Name = %q, want %q", out.Name, in.Name)
+	}
+	if len(out.Nums) != 3 || out.Nums[0] != 1 || out.Nums[1] != 2 || out.Nums[2] != 3 {
+		t.Errorf("Nums = %v, want [1 2 3]", out.Nums)
+	}
+	if out.Nullable == nil || *out.Nullable != nullable {
+		t.Errorf("Nullable = %v, want %q", out.Nullable, nullable)
+	}
+	if out.Inner == nil || out.Inner.Val != 42 {
+		t.Errorf("Inner = %v, want {42}", out.Inner)
+	}
+	if out.H != zx.Handle(7) {
+		t.Errorf("H = %v, want 7", out.H)
+	}
+}
+
+// TestOutOfLineAbsent checks that nil slices, nil string pointers, and nil
+// struct pointers round-trip as absent rather than present-but-empty.
+func TestOutOfLineAbsent(t *testing.T) {
+	in := &outOfLineStruct{Name: "x"}
+	header := &MessageHeader{}
+	buf, handles, err := Marshal(header, in)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	var out outOfLineStruct
+	if _, err := Unmarshal(buf, handles, &out); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if out.Nums != nil {
+		t.Errorf("Nums = %v, want nil", out.Nums)
+	}
+	if out.Nullable != nil {
+		t.Errorf("Nullable = %v, want nil", out.Nullable)
+	}
+	if out.Inner != nil {
+		t.Errorf("Inner = %v, want nil", out.Inner)
+	}
+}
+
+type maxBoundedStruct struct {
+	Name string  `fidl:"s,MAX=4"`
+	Nums []int32 `fidl:"v,MAX=0"`
+}
+
+func (*maxBoundedStruct) InlineAlignment() int { return 8 }
+func (*maxBoundedStruct) InlineSize() int      { return 32 }
+
+// TestMaxTagEnforced checks that a MAX=n tag on a string or vector field is
+// enforced on Marshal: an in-bounds value encodes without error, and an
+// over-limit one is rejected. It also covers MAX=0, which must be enforced
+// as a genuine zero-length bound rather than being mistaken for "no MAX= tag
+// was given" -- both share the same underlying int, distinguished only by
+// the noMax sentinel.
+func TestMaxTagEnforced(t *testing.T) {
+	header := &MessageHeader{}
+
+	in := &maxBoundedStruct{Name: "ok"}
+	if _, _, err := Marshal(header, in); err != nil {
+		t.Errorf("Marshal with in-bounds Name: %v", err)
+	}
+
+	over := &maxBoundedStruct{Name: "toolong"}
+	if _, _, err := Marshal(header, over); err == nil {
+		t.Errorf("Marshal with Name exceeding MAX=4: got nil error, want error")
+	}
+
+	nonEmptyVec := &maxBoundedStruct{Nums: []int32{1}}
+	if _, _, err := Marshal(header, nonEmptyVec); err == nil {
+		t.Errorf("Marshal with Nums exceeding MAX=0: got nil error, want error")
+	}
+
+	emptyVec := &maxBoundedStruct{Nums: []int32{}}
+	if _, _, err := Marshal(header, emptyVec); err != nil {
+		t.Errorf("Marshal with empty Nums under MAX=0: %v", err)
+	}
+}
+
+// node is a self-referential FIDL struct: the standard linked-list/tree
+// shape built from a nullable pointer back to its own type.
+type node struct {
+	Val  int32
+	Next *node
+}
+
+func (*node) InlineAlignment() int { return 8 }
+func (*node) InlineSize() int      { return 16 }
+
+// TestSelfReferentialType checks that a struct with a nullable pointer to
+// its own type builds its typeInfo without infinite recursion, and that a
+// chain of nodes ending in a nil Next round-trips.
+func TestSelfReferentialType(t *testing.T) {
+	in := &node{Val: 1, Next: &node{Val: 2, Next: &node{Val: 3}}}
+	header := &MessageHeader{}
+	buf, handles, err := Marshal(header, in)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	var out node
+	if _, err := Unmarshal(buf, handles, &out); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if out.Val != 1 || out.Next == nil || out.Next.Val != 2 || out.Next.Next == nil || out.Next.Next.Val != 3 || out.Next.Next.Next != nil {
+		t.Fatalf("got %+v, want chain 1 -> 2 -> 3 -> nil", out)
+	}
+}
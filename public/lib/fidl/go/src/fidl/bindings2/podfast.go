@@ -0,0 +1,179 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package bindings2
+
+import (
+	"reflect"
+	"sync"
+	"unsafe"
+)
+
+// podEntry records the result of checking whether a reflect.Type is
+// "FIDL wire-compatible" plain old data: a type whose Go memory layout is
+// byte-for-byte identical to the FIDL wire format the reflective encoder and
+// decoder in this package would otherwise produce one field at a time. When ok
+// is true, size and align are the type's wire size and alignment, and values
+// of the type can be copied to or from the wire with a single memmove
+// instead of a per-field walk.
+type podEntry struct {
+	ok    bool
+	size  int
+	align int
+}
+
+// podCache memoizes podEntry by reflect.Type, since computing it requires
+// walking every field of t (and, transitively, of any nested struct or
+// array element type) and is only worth paying once per type.
+var podCache sync.Map // map[reflect.Type]podEntry
+
+// podTypeInfo returns the (possibly cached) podEntry for t.
+func podTypeInfo(t reflect.Type) podEntry {
+	if cached, ok := podCache.Load(t); ok {
+		return cached.(podEntry)
+	}
+	entry := computePODTypeInfo(t)
+	podCache.Store(t, entry)
+	return entry
+}
+
+// computePODTypeInfo walks t the same way encoder.marshal/decoder.unmarshal
+// would and checks, at every step, that the Go field offset
+// (equivalent to unsafe.Offsetof) matches the FIDL wire offset the
+// reflective path would have assigned it. Any divergence -- a
+// compiler-inserted padding byte, a field kind the memmove path can't trust
+// (bools, handles, pointers, strings, interfaces, slices) -- forces the
+// caller back onto the reflective path.
+func computePODTypeInfo(t reflect.Type) podEntry {
+	// zx.Handle's underlying Kind is an integer kind, but a handle's wire
+	// representation is a presence sentinel plus an out-of-band handle,
+	// not its raw integer value, so it must never be memmove'd.
+	if isHandleType(t) {
+		return podEntry{}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		// A FIDL bool is only valid on the wire as byte 0 or 1; the
+		// reflective decoder rejects anything else. A raw memmove can't
+		// perform that check, so any type containing a bool -- at any
+		// depth -- is excluded from the fast path entirely, rather than
+		// silently skipping validation depending on whether it happened to
+		// qualify for memmove.
+		return podEntry{}
+	case reflect.Int8, reflect.Uint8,
+		reflect.Int16, reflect.Uint16,
+		reflect.Int32, reflect.Uint32, reflect.Float32,
+		reflect.Int64, reflect.Uint64, reflect.Float64:
+		size := kindSize(t.Kind())
+		if int(t.Size()) != size {
+			// Should be unreachable for real Go types, but don't trust a
+			// mismatch we can't explain.
+			return podEntry{}
+		}
+		return podEntry{ok: true, size: size, align: size}
+
+	case reflect.Array:
+		elem := podTypeInfo(t.Elem())
+		if !elem.ok {
+			return podEntry{}
+		}
+		// FIDL arrays, like Go arrays, pack elements back-to-back with no
+		// inter-element padding; the element's Go stride must agree.
+		if int(t.Elem().Size()) != elem.size {
+			return podEntry{}
+		}
+		return podEntry{ok: true, size: elem.size * t.Len(), align: elem.align}
+
+	case reflect.Struct:
+		payload, ok := reflect.New(t).Interface().(Payload)
+		if !ok {
+			return podEntry{}
+		}
+		if _, ok := reflect.New(t).Interface().(Union); ok {
+			// A union's variants overlap on the wire at the same offset,
+			// discriminated by a tag; its Go fields, by contrast, occupy
+			// distinct, non-overlapping memory. The two can never be
+			// memmove-compatible.
+			return podEntry{}
+		}
+		wireOffset := 0
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				// Unexported fields aren't marshalled; skip without
+				// consuming wire space, same as encoder.marshal.
+				continue
+			}
+			field := podTypeInfo(f.Type)
+			if !field.ok {
+				return podEntry{}
+			}
+			wireOffset = align(wireOffset, field.align)
+			if int(f.Offset) != wireOffset {
+				return podEntry{}
+			}
+			wireOffset += field.size
+		}
+		alignment := payload.InlineAlignment()
+		size := align(wireOffset, alignment)
+		if int(t.Size()) != size {
+			return podEntry{}
+		}
+		return podEntry{ok: true, size: size, align: alignment}
+
+	default:
+		return podEntry{}
+	}
+}
+
+// kindSize returns the FIDL wire byte-width of a fixed-size scalar kind.
+func kindSize(k reflect.Kind) int {
+	switch k {
+	case reflect.Bool, reflect.Int8, reflect.Uint8:
+		return 1
+	case reflect.Int16, reflect.Uint16:
+		return 2
+	case reflect.Int32, reflect.Uint32, reflect.Float32:
+		return 4
+	default:
+		return 8
+	}
+}
+
+// bytesFromPointer returns a []byte of length size backed by the memory at
+// p, without copying. The caller must ensure p remains valid and addressable
+// for the lifetime of the returned slice.
+func bytesFromPointer(p unsafe.Pointer, size int) []byte {
+	var b []byte
+	sh := (*reflect.SliceHeader)(unsafe.Pointer(&b))
+	sh.Data = uintptr(p)
+	sh.Len = size
+	sh.Cap = size
+	return b
+}
+
+// writePOD copies size bytes directly from v's underlying memory into the
+// encoder's buffer at the current (already-aligned) head, advancing head by
+// size. v must be addressable and its type must have passed
+// computePODTypeInfo.
+func (e *encoder) writePOD(v reflect.Value, size int) {
+	if size == 0 {
+		return
+	}
+	copy(e.buffer[e.head:e.head+size], bytesFromPointer(unsafe.Pointer(v.UnsafeAddr()), size))
+	e.head += size
+}
+
+// readPOD copies size bytes directly from the decoder's buffer at the
+// current (already-aligned) head into v's underlying memory, advancing head
+// by size. v must be addressable and its type must have passed
+// computePODTypeInfo.
+func (d *decoder) readPOD(v reflect.Value, size int) {
+	if size == 0 {
+		return
+	}
+	copy(bytesFromPointer(unsafe.Pointer(v.UnsafeAddr()), size), d.buffer[d.head:d.head+size])
+	d.head += size
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package bindings2
+
+import (
+	"reflect"
+	"testing"
+)
+
+type podPoint struct {
+	X, Y int32
+}
+
+func (*podPoint) InlineAlignment() int { return 4 }
+func (*podPoint) InlineSize() int      { return 8 }
+
+type podPointList struct {
+	Points [4]podPoint
+}
+
+func (*podPointList) InlineAlignment() int { return 4 }
+func (*podPointList) InlineSize() int      { return 32 }
+
+// TestPODTypeInfoConfirmsFastPath checks that [4]podPoint is recognized as
+// wire-compatible, so that TestPODRoundTrip below is actually exercising
+// the memmove fast path and not silently falling back to the reflective
+// field-by-field one.
+func TestPODTypeInfoConfirmsFastPath(t *testing.T) {
+	arrayType := reflect.TypeOf([4]podPoint{})
+	pod := podTypeInfo(arrayType)
+	if !pod.ok {
+		t.Fatalf("expected [4]podPoint to be recognized as POD")
+	}
+	if pod.size != 32 {
+		t.Fatalf("got size %d, want 32", pod.size)
+	}
+}
+
+type podWithBool struct {
+	Flag bool
+	X    int32
+}
+
+func (*podWithBool) InlineAlignment() int { return 4 }
+func (*podWithBool) InlineSize() int      { return 8 }
+
+// TestPODTypeInfoExcludesBool checks that a struct containing a bool field
+// is never recognized as wire-compatible, even though bool and int32 are
+// both fixed-size, naturally-aligned Go kinds that would otherwise satisfy
+// computePODTypeInfo's offset checks. A FIDL bool is only valid on the wire
+// as byte 0 or 1, a constraint only the reflective decoder enforces, so
+// anything containing one must be routed there instead of memmove'd.
+func TestPODTypeInfoExcludesBool(t *testing.T) {
+	pod := podTypeInfo(reflect.TypeOf(podWithBool{}))
+	if pod.ok {
+		t.Fatalf("expected podWithBool to be excluded from the memmove fast path")
+	}
+}
+
+// TestBoolRejectsInvalidByte checks that an invalid bool byte on the wire is
+// rejected rather than silently decoded as true, which is what a raw
+// memmove would do.
+func TestBoolRejectsInvalidByte(t *testing.T) {
+	in := &podWithBool{Flag: true, X: 1}
+	header := &MessageHeader{}
+	buf, handles, err := Marshal(header, in)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	// Corrupt the encoded bool byte, which sits at the start of the
+	// payload, right after the message header.
+	buf[MessageHeaderSize] = 0x07
+
+	var out podWithBool
+	if _, err := Unmarshal(buf, handles, &out); err == nil {
+		t.Fatalf("Unmarshal with invalid bool byte: got nil error, want error")
+	}
+}
+
+// TestPODRoundTrip checks that an array of structs matching
+// computePODTypeInfo's criteria round-trips correctly via the memmove fast
+// path.
+func TestPODRoundTrip(t *testing.T) {
+	in := &podPointList{Points: [4]podPoint{
+		{X: 1, Y: 2},
+		{X: 3, Y: 4},
+		{X: -5, Y: 6},
+		{X: 7, Y: -8},
+	}}
+
+	header := &MessageHeader{}
+	buf, handles, err := Marshal(header, in)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	var out podPointList
+	if _, err := Unmarshal(buf, handles, &out); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if out != *in {
+		t.Fatalf("got %+v, want %+v", out, *in)
+	}
+}
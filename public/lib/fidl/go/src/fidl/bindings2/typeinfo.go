@@ -0,0 +1,446 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package bindings2
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+)
+
+// fieldKind enumerates the shapes typeInfo needs to dispatch on. It mirrors
+// reflect.Kind for the subset of kinds FIDL structs are currently allowed to
+// contain, plus kindArray/kindStruct for the two inline container shapes and
+// the string, vector, nullable, handle, and union shapes.
+type fieldKind int
+
+const (
+	kindBool fieldKind = iota
+	kindInt8
+	kindInt16
+	kindInt32
+	kindInt64
+	kindUint8
+	kindUint16
+	kindUint32
+	kindUint64
+	kindFloat32
+	kindFloat64
+	kindArray
+	kindStruct
+	kindString
+	kindNullableString
+	kindVector
+	kindNullableStruct
+	kindHandle
+	kindUnion
+)
+
+// fieldInfo is one entry in a struct typeInfo's field table: where the field
+// lives in wire order, and the typeInfo describing how to encode/decode it.
+type fieldInfo struct {
+	// wireOffset is the field's byte offset from the start of the parent
+	// struct's FIDL encoding.
+	wireOffset int
+
+	// index is the field's index within the parent struct, for use with
+	// reflect.Value.Field.
+	index int
+
+	// info describes the field's own type.
+	info *typeInfo
+
+	// maxSize and hasMax come from a `fidl:"...,MAX=n"` struct tag, and
+	// bound the byte length of a kindString/kindNullableString field or
+	// the element count of a kindVector field. They live here rather than
+	// on the shared *typeInfo, since the same string/[]T Go type can be
+	// reused across fields with different MAX tags.
+	maxSize int
+	hasMax  bool
+}
+
+// unionVariant is one entry in a union typeInfo's variant table: the
+// discriminant tag that selects it, its field index within the union
+// struct, and its own typeInfo.
+type unionVariant struct {
+	tag   uint32
+	index int
+	info  *typeInfo
+}
+
+// typeInfo is a precomputed description of how to marshal/unmarshal a single
+// reflect.Type, so that Marshal/Unmarshal don't need to re-derive it (via
+// t.Kind() switches and Payload type assertions) on every call. It is built
+// once per type and cached in typeInfoCache.
+//
+// For kindArray and kindStruct, pod is set when the whole subtree has
+// already been shown (by podTypeInfo, see podfast.go) to be a byte-for-byte
+// match between its Go layout and its FIDL wire layout; in that case size
+// and alignment are all marshalInfo/unmarshalInfo need; elem/fields are left
+// unpopulated and unused.
+type typeInfo struct {
+	kind      fieldKind
+	size      int
+	alignment int
+
+	// pod is true if this array or struct can be memmove'd as a whole;
+	// see podfast.go.
+	pod bool
+
+	// arrayLen and elem are populated for kindArray when !pod.
+	arrayLen int
+	elem     *typeInfo
+
+	// fields is populated for kindStruct when !pod.
+	fields []fieldInfo
+
+	// handleViaInterface is set for kindHandle when the Go field type is
+	// not zx.Handle itself but a type implementing HandleMarshaler.
+	handleViaInterface bool
+
+	// unionVariants is populated for kindUnion: one entry per exported
+	// field of the union struct, keyed by its fidl:"TAG=n" tag.
+	unionVariants []unionVariant
+
+	// dataAlignment is populated for kindUnion: the alignment of the
+	// variant data region, i.e. the max alignment of any variant. The
+	// discriminant tag is padded out to this alignment before the
+	// selected variant's own encoding begins.
+	dataAlignment int
+}
+
+// typeInfoCache memoizes typeInfo by reflect.Type.
+var typeInfoCache sync.Map // map[reflect.Type]*typeInfo
+
+// getTypeInfo returns the (possibly cached) typeInfo for t, building it on
+// first use.
+//
+// A zero-value *typeInfo is stored in the cache before t's own fields are
+// inspected, rather than after buildTypeInfo returns. This matters for a
+// self-referential FIDL struct -- e.g. a nullable pointer to its own type,
+// the standard linked-list/tree shape -- whose buildTypeInfo call recurses
+// back into getTypeInfo(t) while still building t's fields. With the
+// placeholder in place, that nested call finds the same (as-yet-unfinished)
+// *typeInfo instead of recursing into buildTypeInfo again forever;
+// buildTypeInfo fills the placeholder in in place, so every holder of the
+// pointer sees the completed fields once the outermost call returns.
+func getTypeInfo(t reflect.Type) (*typeInfo, error) {
+	if cached, ok := typeInfoCache.Load(t); ok {
+		return cached.(*typeInfo), nil
+	}
+	info := &typeInfo{}
+	actual, loaded := typeInfoCache.LoadOrStore(t, info)
+	if loaded {
+		// Another goroutine (or, for a self-referential type, this same
+		// call stack) already claimed t; use its placeholder instead of
+		// ours.
+		return actual.(*typeInfo), nil
+	}
+	if err := buildTypeInfo(t, info); err != nil {
+		typeInfoCache.Delete(t)
+		return nil, err
+	}
+	return info, nil
+}
+
+// buildTypeInfo computes the typeInfo for t into info, which getTypeInfo has
+// already inserted into typeInfoCache. It consults podTypeInfo for every
+// Array and Struct type it encounters -- including t itself -- and bakes
+// that decision into the resulting typeInfo once, rather than rechecking it
+// on every Marshal/Unmarshal call.
+func buildTypeInfo(t reflect.Type, info *typeInfo) error {
+	// zx.Handle and types implementing HandleMarshaler are checked ahead of
+	// the Kind() switch below: zx.Handle's underlying Kind is an integer
+	// kind (it would otherwise be mistaken for a plain scalar), and a
+	// HandleMarshaler wrapper's Kind is typically Struct.
+	if isHandleType(t) {
+		*info = typeInfo{kind: kindHandle, size: 4, alignment: 4, handleViaInterface: t != handleType}
+		return nil
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		*info = typeInfo{kind: kindBool, size: 1, alignment: 1}
+	case reflect.Int8:
+		*info = typeInfo{kind: kindInt8, size: 1, alignment: 1}
+	case reflect.Int16:
+		*info = typeInfo{kind: kindInt16, size: 2, alignment: 2}
+	case reflect.Int32:
+		*info = typeInfo{kind: kindInt32, size: 4, alignment: 4}
+	case reflect.Int64:
+		*info = typeInfo{kind: kindInt64, size: 8, alignment: 8}
+	case reflect.Uint8:
+		*info = typeInfo{kind: kindUint8, size: 1, alignment: 1}
+	case reflect.Uint16:
+		*info = typeInfo{kind: kindUint16, size: 2, alignment: 2}
+	case reflect.Uint32:
+		*info = typeInfo{kind: kindUint32, size: 4, alignment: 4}
+	case reflect.Uint64:
+		*info = typeInfo{kind: kindUint64, size: 8, alignment: 8}
+	case reflect.Float32:
+		*info = typeInfo{kind: kindFloat32, size: 4, alignment: 4}
+	case reflect.Float64:
+		*info = typeInfo{kind: kindFloat64, size: 8, alignment: 8}
+	case reflect.String:
+		// A non-nullable FIDL string: 8 bytes of length followed by 8
+		// bytes of presence, which is always FIDL_ALLOC_PRESENT for this
+		// Go representation. Use *string for a nullable FIDL string.
+		*info = typeInfo{kind: kindString, size: 16, alignment: 8}
+	case reflect.Slice:
+		elem, err := getTypeInfo(t.Elem())
+		if err != nil {
+			return err
+		}
+		// A FIDL vector has the same 16-byte inline shape as a string; its
+		// element data lives out-of-line. A nil slice marshals as an
+		// absent vector, so no separate nullable representation is needed.
+		*info = typeInfo{kind: kindVector, size: 16, alignment: 8, elem: elem}
+	case reflect.Ptr:
+		switch t.Elem().Kind() {
+		case reflect.Struct:
+			elem, err := getTypeInfo(t.Elem())
+			if err != nil {
+				return err
+			}
+			*info = typeInfo{kind: kindNullableStruct, size: 8, alignment: 8, elem: elem}
+		case reflect.String:
+			*info = typeInfo{kind: kindNullableString, size: 16, alignment: 8}
+		default:
+			return fmt.Errorf("unsupported pointer type %s: only *struct and *string are supported, for nullable FIDL structs and strings", t)
+		}
+	case reflect.Array:
+		if pod := podTypeInfo(t); pod.ok {
+			*info = typeInfo{kind: kindArray, size: pod.size, alignment: pod.align, pod: true, arrayLen: t.Len()}
+			break
+		}
+		elem, err := getTypeInfo(t.Elem())
+		if err != nil {
+			return err
+		}
+		*info = typeInfo{
+			kind:      kindArray,
+			size:      elem.size * t.Len(),
+			alignment: elem.alignment,
+			arrayLen:  t.Len(),
+			elem:      elem,
+		}
+	case reflect.Struct:
+		if pod := podTypeInfo(t); pod.ok {
+			*info = typeInfo{kind: kindStruct, size: pod.size, alignment: pod.align, pod: true}
+			break
+		}
+
+		if _, ok := reflect.New(t).Interface().(Union); ok {
+			union, err := buildUnionTypeInfo(t)
+			if err != nil {
+				return err
+			}
+			*info = *union
+			break
+		}
+
+		// Note that Addr can fail if the originally derived value is not "addressable",
+		// meaning the root ValueOf() call was on a struct value, not a pointer. However,
+		// we guarantee the struct is addressable by forcing a Payload to be passed in
+		// (a struct value will never cast as an interface).
+		payload, ok := reflect.New(t).Interface().(Payload)
+		if !ok {
+			return fmt.Errorf("struct %s must implement Payload", t.Name())
+		}
+		alignment := payload.InlineAlignment()
+
+		wireOffset := 0
+		var fields []fieldInfo
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			// If it's an unexported field, ignore it.
+			if f.PkgPath != "" {
+				continue
+			}
+			child, err := getTypeInfo(f.Type)
+			if err != nil {
+				return err
+			}
+			maxSize, hasMax, err := parseFidlTag(f.Tag.Get("fidl"))
+			if err != nil {
+				return fmt.Errorf("field %s.%s: %v", t.Name(), f.Name, err)
+			}
+			wireOffset = align(wireOffset, child.alignment)
+			fields = append(fields, fieldInfo{
+				wireOffset: wireOffset,
+				index:      i,
+				info:       child,
+				maxSize:    maxSize,
+				hasMax:     hasMax,
+			})
+			wireOffset += child.size
+		}
+		size := align(wireOffset, alignment)
+		*info = typeInfo{kind: kindStruct, size: size, alignment: alignment, fields: fields}
+	default:
+		return fmt.Errorf("unsupported type kind %s for type %s", t.Kind(), t.Name())
+	}
+	return nil
+}
+
+// noMax marks the absence of a MAX= tag, so that a field explicitly tagged
+// fidl:"...,MAX=0" -- a legitimate zero-length bound -- isn't confused with
+// "no bound was declared."
+const noMax = -1
+
+// marshalInfo writes v, described by info, to e's buffer at the current
+// head, advancing head past it. It is the table-driven replacement for
+// recursing on t.Kind(): info.kind and info.fields/elem were computed once
+// by buildTypeInfo, so this is a plain loop with no further reflect.Type
+// inspection or Payload assertions.
+//
+// maxSize is the MAX= tag value declared on the struct field v came from, or
+// noMax if none was declared; it only affects kindString/kindNullableString/
+// kindVector.
+func (e *encoder) marshalInfo(info *typeInfo, v reflect.Value, maxSize int) error {
+	switch info.kind {
+	case kindBool:
+		i := uint64(0)
+		if v.Bool() {
+			i = 1
+		}
+		e.writeUint(i, 1)
+	case kindInt8:
+		e.writeInt(v.Int(), 1)
+	case kindInt16:
+		e.writeInt(v.Int(), 2)
+	case kindInt32:
+		e.writeInt(v.Int(), 4)
+	case kindInt64:
+		e.writeInt(v.Int(), 8)
+	case kindUint8:
+		e.writeUint(v.Uint(), 1)
+	case kindUint16:
+		e.writeUint(v.Uint(), 2)
+	case kindUint32:
+		e.writeUint(v.Uint(), 4)
+	case kindUint64:
+		e.writeUint(v.Uint(), 8)
+	case kindFloat32:
+		e.writeUint(uint64(math.Float32bits(float32(v.Float()))), 4)
+	case kindFloat64:
+		e.writeUint(math.Float64bits(v.Float()), 8)
+	case kindHandle:
+		return e.marshalHandle(info, v)
+	case kindString:
+		return e.marshalString(v, maxSize)
+	case kindNullableString:
+		return e.marshalNullableString(v, maxSize)
+	case kindVector:
+		return e.marshalVector(info, v, maxSize)
+	case kindNullableStruct:
+		return e.marshalNullableStruct(info, v)
+	case kindUnion:
+		return e.marshalUnion(info, v)
+	case kindArray:
+		e.head = align(e.head, info.alignment)
+		if info.pod {
+			e.writePOD(v, info.size)
+			break
+		}
+		for i := 0; i < info.arrayLen; i++ {
+			if err := e.marshalInfo(info.elem, v.Index(i), noMax); err != nil {
+				return err
+			}
+		}
+	case kindStruct:
+		e.head = align(e.head, info.alignment)
+		if info.pod {
+			e.writePOD(v, info.size)
+			break
+		}
+		for _, f := range info.fields {
+			fieldMax := noMax
+			if f.hasMax {
+				fieldMax = f.maxSize
+			}
+			if err := e.marshalInfo(f.info, v.Field(f.index), fieldMax); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// unmarshalInfo is the decoding counterpart to marshalInfo.
+func (d *decoder) unmarshalInfo(info *typeInfo, v reflect.Value, maxSize int) error {
+	switch info.kind {
+	case kindBool:
+		i := d.readUint(1)
+		switch i {
+		case 0:
+			v.SetBool(false)
+		case 1:
+			v.SetBool(true)
+		default:
+			return fmt.Errorf("%d is not a valid bool value", i)
+		}
+	case kindInt8:
+		v.SetInt(d.readInt(1))
+	case kindInt16:
+		v.SetInt(d.readInt(2))
+	case kindInt32:
+		v.SetInt(d.readInt(4))
+	case kindInt64:
+		v.SetInt(d.readInt(8))
+	case kindUint8:
+		v.SetUint(d.readUint(1))
+	case kindUint16:
+		v.SetUint(d.readUint(2))
+	case kindUint32:
+		v.SetUint(d.readUint(4))
+	case kindUint64:
+		v.SetUint(d.readUint(8))
+	case kindFloat32:
+		v.SetFloat(float64(math.Float32frombits(uint32(d.readUint(4)))))
+	case kindFloat64:
+		v.SetFloat(math.Float64frombits(d.readUint(8)))
+	case kindHandle:
+		return d.unmarshalHandle(info, v)
+	case kindString:
+		return d.unmarshalString(v, maxSize)
+	case kindNullableString:
+		return d.unmarshalNullableString(v, maxSize)
+	case kindVector:
+		return d.unmarshalVector(info, v, maxSize)
+	case kindNullableStruct:
+		return d.unmarshalNullableStruct(info, v)
+	case kindUnion:
+		return d.unmarshalUnion(info, v)
+	case kindArray:
+		d.head = align(d.head, info.alignment)
+		if info.pod {
+			d.readPOD(v, info.size)
+			return nil
+		}
+		for i := 0; i < info.arrayLen; i++ {
+			if err := d.unmarshalInfo(info.elem, v.Index(i), noMax); err != nil {
+				return err
+			}
+		}
+	case kindStruct:
+		d.head = align(d.head, info.alignment)
+		if info.pod {
+			d.readPOD(v, info.size)
+			return nil
+		}
+		for _, f := range info.fields {
+			fieldMax := noMax
+			if f.hasMax {
+				fieldMax = f.maxSize
+			}
+			if err := d.unmarshalInfo(f.info, v.Field(f.index), fieldMax); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package bindings2
+
+import "testing"
+
+// These types are deliberately not POD (each level adds a string field, so
+// podTypeInfo bails out), to measure the table-driven struct/array dispatch
+// in marshalInfo/unmarshalInfo rather than the memmove fast path.
+type deepLeaf struct {
+	Tag string
+	Val int32
+}
+
+func (*deepLeaf) InlineAlignment() int { return 8 }
+func (*deepLeaf) InlineSize() int      { return 24 }
+
+type deepMiddle struct {
+	Tag    string
+	Leaves [4]deepLeaf
+}
+
+func (*deepMiddle) InlineAlignment() int { return 8 }
+func (*deepMiddle) InlineSize() int      { return 16 + 24*4 }
+
+type deepRoot struct {
+	Tag     string
+	Middles [4]deepMiddle
+}
+
+func (*deepRoot) InlineAlignment() int { return 8 }
+func (*deepRoot) InlineSize() int      { return 16 + (16+24*4)*4 }
+
+func newDeepRoot() *deepRoot {
+	r := &deepRoot{Tag: "root"}
+	for i := range r.Middles {
+		r.Middles[i].Tag = "middle"
+		for j := range r.Middles[i].Leaves {
+			r.Middles[i].Leaves[j] = deepLeaf{Tag: "leaf", Val: int32(i*4 + j)}
+		}
+	}
+	return r
+}
+
+// TestDeepNestedRoundTrip exercises marshalInfo/unmarshalInfo's kindArray/
+// kindStruct recursion through several levels of nested, non-POD structs.
+func TestDeepNestedRoundTrip(t *testing.T) {
+	in := newDeepRoot()
+	header := &MessageHeader{}
+	buf, handles, err := Marshal(header, in)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	var out deepRoot
+	if _, err := Unmarshal(buf, handles, &out); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if out.Tag != "root" || out.Middles[3].Leaves[3].Val != 15 {
+		t.Fatalf("got %+v", out)
+	}
+}
+
+// BenchmarkMarshalDeepNested and BenchmarkUnmarshalDeepNested measure the
+// table-driven typeInfo path (built once per type and memoized in
+// typeInfoCache) over a deeply nested, non-POD struct, the shape the
+// per-call reflect.Kind() dispatch this replaced used to pay a fresh
+// reflection cost for on every Marshal/Unmarshal call.
+func BenchmarkMarshalDeepNested(b *testing.B) {
+	in := newDeepRoot()
+	header := &MessageHeader{}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := Marshal(header, in); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshalDeepNested(b *testing.B) {
+	in := newDeepRoot()
+	header := &MessageHeader{}
+	buf, handles, err := Marshal(header, in)
+	if err != nil {
+		b.Fatal(err)
+	}
+	var out deepRoot
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Unmarshal(buf, handles, &out); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
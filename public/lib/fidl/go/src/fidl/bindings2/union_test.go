@@ -0,0 +1,70 @@
+// Copyright 2018 The Fuchsia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package bindings2
+
+import "testing"
+
+type shapeUnion struct {
+	tag    uint32
+	Radius int32  `fidl:"TAG=0"`
+	Label  string `fidl:"TAG=1"`
+}
+
+func (u *shapeUnion) Which() uint32     { return u.tag }
+func (u *shapeUnion) SetWhich(t uint32) { u.tag = t }
+
+func (*shapeUnion) InlineAlignment() int { return 8 }
+func (*shapeUnion) InlineSize() int      { return 24 }
+
+type shapeUnionWrapper struct {
+	Shape shapeUnion
+}
+
+func (*shapeUnionWrapper) InlineAlignment() int { return 8 }
+func (*shapeUnionWrapper) InlineSize() int      { return 24 }
+
+// TestUnionRoundTrip checks that each variant round-trips, that the
+// unselected variant is zeroed on decode, and that an out-of-range tag is
+// rejected on encode.
+func TestUnionRoundTrip(t *testing.T) {
+	header := &MessageHeader{}
+
+	in := &shapeUnionWrapper{Shape: shapeUnion{tag: 1, Label: "circle"}}
+	buf, handles, err := Marshal(header, in)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var out shapeUnionWrapper
+	if _, err := Unmarshal(buf, handles, &out); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if out.Shape.Which() != 1 || out.Shape.Label != "circle" {
+		t.Fatalf("got %+v, want tag=1 Label=circle", out.Shape)
+	}
+	if out.Shape.Radius != 0 {
+		t.Fatalf("unselected variant Radius not zeroed: %d", out.Shape.Radius)
+	}
+
+	in2 := &shapeUnionWrapper{Shape: shapeUnion{tag: 0, Radius: 5}}
+	buf2, handles2, err := Marshal(header, in2)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var out2 shapeUnionWrapper
+	if _, err := Unmarshal(buf2, handles2, &out2); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if out2.Shape.Which() != 0 || out2.Shape.Radius != 5 {
+		t.Fatalf("got %+v, want tag=0 Radius=5", out2.Shape)
+	}
+	if out2.Shape.Label != "" {
+		t.Fatalf("unselected variant Label not zeroed: %q", out2.Shape.Label)
+	}
+
+	bad := &shapeUnionWrapper{Shape: shapeUnion{tag: 99}}
+	if _, _, err := Marshal(header, bad); err == nil {
+		t.Fatalf("expected error for out-of-range union tag")
+	}
+}